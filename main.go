@@ -20,13 +20,18 @@
 // 2. ...
 package main
 
-// TODO splice!
-
 import (
+	"bufio"
+	"errors"
 	"flag"
-	"io"
+	"fmt"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 )
 
 type GuardianDecision int
@@ -35,32 +40,75 @@ const (
 	GDError GuardianDecision = iota
 	GDPassToProxee
 	GDPassToGuardian
+	GDReject        // only sent under -guardian-protocol=v1
+	GDRewriteProxee // only sent under -guardian-protocol=v1
+	GDContinue      // internal to RunGuardianVerdictReader, never reaches Handle
 )
 
+// GuardianVerdict is what a guardian reader sends down guardian_decision_chan.
+// Under -guardian-protocol=legacy, kind is always GDError, GDPassToProxee or
+// GDPassToGuardian and the other fields are unused. Under v1, GDReject may
+// carry a code and body to return to the client, and GDRewriteProxee carries
+// the address of the new backend (see protocol_v1.go).
+type GuardianVerdict struct {
+	kind GuardianDecision
+	code byte
+	body []byte
+	addr string
+}
+
 type WorkerFeedback int
 
 const (
 	WFFatalError           WorkerFeedback = iota // some fatal error occured in a worker
 	WFDoNotWriteToGuardian                       // do not write to the guardian anymore
+	WFDoNotWriteToProxee                         // do not write to the proxee anymore
+	WFPumpDone                                   // a post-decision pump returned cleanly
 )
 
 type Connection struct {
 	id    int
 	csock *net.TCPConn // socket to the client
 	gsock *net.TCPConn // socket to the guardian
-	psock *net.TCPConn // socket to the proxee
+
+	psockMu sync.Mutex   // guards psock against a concurrent rewriteProxee
+	psock   *net.TCPConn // socket to the proxee
+
+	creader    *bufio.Reader // buffered reads from csock, so Router can peek
+	route      *Route        // route this connection was matched to, if any
+	clientAddr net.Addr      // csock.RemoteAddr(), or the PROXY-protocol-decoded address
 
 	feedback_chan          chan WorkerFeedback
 	client_buffers_chan    chan []byte // buffers read from client
-	guardian_decision_chan chan GuardianDecision
+	guardian_decision_chan chan GuardianVerdict
 
 	write_to_guardian bool // copy client data to guardian
 	write_to_proxee   bool // copy client data to proxee
 }
 
+// proxeeSock returns the current proxee socket. A FrameVerdictRewriteProxee
+// verdict (-guardian-protocol=v1 only) can swap it out via rewriteProxee
+// while RunWriter is concurrently writing to it, so every access after the
+// initial dial goes through here instead of reading c.psock directly.
+func (c *Connection) proxeeSock() *net.TCPConn {
+	c.psockMu.Lock()
+	defer c.psockMu.Unlock()
+	return c.psock
+}
+
 var guardian_addr string
 var proxee_addr string
 var listen_addr string
+var splice_mode string // "on", "off" or "auto"; see splice_linux.go
+
+var guardian_protocol string // "legacy" or "v1"; see protocol_v1.go
+
+// Deadlines, all refreshed as described in setReadDeadline/setWriteDeadline.
+// A value of zero disables the corresponding deadline.
+var handshake_timeout time.Duration // bounds the proxee/guardian dial and time-to-first-decision on csock/psock
+var guardian_timeout time.Duration  // bounds each guardian read/write on gsock
+var idle_timeout time.Duration      // refreshed on every successful transfer once decided
+var shutdown_grace time.Duration    // how long to let connections drain on SIGINT/SIGTERM
 
 var res_proxee_addr *net.TCPAddr
 var res_guardian_addr *net.TCPAddr
@@ -79,8 +127,61 @@ func main() {
 		"TCP service to be proxeed, eg. google.com:80")
 	flag.StringVar(&guardian_addr, "guardian", "localhost:4321",
 		"Address of the guardian, eg. localhost:4321")
+	flag.StringVar(&splice_mode, "splice", "auto",
+		"Whether to pump the post-decision stream with splice(2) instead of "+
+			"copying through a userspace buffer: on, off or auto. Has no "+
+			"effect on non-Linux builds.")
+	flag.StringVar(&guardian_protocol, "guardian-protocol", "legacy",
+		"Protocol spoken to the guardian: legacy (single 'g'/'p' decision "+
+			"byte) or v1 (framed handshake with connection metadata and a "+
+			"stream of typed verdicts, see protocol_v1.go)")
+	flag.BoolVar(&acceptProxyProtocol, "accept-proxy-protocol", false,
+		"Parse a HAProxy PROXY protocol v1 or v2 header off each client "+
+			"connection before any bytes are mirrored to the guardian, and use "+
+			"the address it carries in logs and the guardian handshake instead "+
+			"of the connection's real peer address (see proxy_protocol.go).")
+	flag.StringVar(&sendProxyProtocol, "send-proxy-protocol", "",
+		"Write a PROXY protocol header to the proxee immediately after "+
+			"dialing it, so it sees the real client address too: empty "+
+			"(default, disabled), v1 or v2.")
+	flag.StringVar(&routerConfigPath, "routes", "",
+		"Path to a JSON routing table (see router.go); when set, -proxee is "+
+			"only used as the backend for connections that no route matches "+
+			"and no default route is configured. Reloaded on SIGHUP.")
+	flag.DurationVar(&handshake_timeout, "handshake-timeout", 10*time.Second,
+		"Maximum time to wait for the proxee/guardian dial, the first bytes "+
+			"from the client, and the guardian's decision. Zero disables "+
+			"the deadline.")
+	flag.DurationVar(&guardian_timeout, "guardian-timeout", 10*time.Second,
+		"Maximum time to wait for each read from or write to the guardian. "+
+			"Zero disables the deadline.")
+	flag.DurationVar(&idle_timeout, "idle-timeout", 5*time.Minute,
+		"Maximum time a pumped connection may go without transferring data, "+
+			"refreshed on every successful read or write. Zero disables the "+
+			"deadline.")
+	flag.DurationVar(&shutdown_grace, "shutdown-grace", 30*time.Second,
+		"On SIGINT/SIGTERM, how long to let in-flight connections drain "+
+			"before forcibly closing them.")
 	flag.Parse()
 
+	switch splice_mode {
+	case "on", "off", "auto":
+	default:
+		log.Fatalf("Invalid -splice value %q, must be one of on, off, auto", splice_mode)
+	}
+
+	switch guardian_protocol {
+	case "legacy", "v1":
+	default:
+		log.Fatalf("Invalid -guardian-protocol value %q, must be legacy or v1", guardian_protocol)
+	}
+
+	switch sendProxyProtocol {
+	case "", "v1", "v2":
+	default:
+		log.Fatalf("Invalid -send-proxy-protocol value %q, must be v1 or v2", sendProxyProtocol)
+	}
+
 	// Resolve addresses
 	res_listen_addr, err = net.ResolveTCPAddr("tcp", listen_addr)
 	if err != nil {
@@ -95,6 +196,17 @@ func main() {
 		log.Fatalf("Failed to resolve %v: %v", proxee_addr, err)
 	}
 
+	if routerConfigPath != "" {
+		reloadRouter()
+		sighup_chan := make(chan os.Signal, 1)
+		signal.Notify(sighup_chan, syscall.SIGHUP)
+		go func() {
+			for range sighup_chan {
+				reloadRouter()
+			}
+		}()
+	}
+
 	// Set up listen socket
 	lsock, err := net.ListenTCP("tcp", res_listen_addr)
 	if err != nil {
@@ -105,10 +217,20 @@ func main() {
 	csock_chan := make(chan *net.TCPConn)
 	go RunAccepter(lsock, csock_chan)
 
+	term_chan := make(chan os.Signal, 1)
+	signal.Notify(term_chan, syscall.SIGINT, syscall.SIGTERM)
+
+	shutting_down := false
+	var grace_chan <-chan time.Time
+
 	nconns := 0
 	for {
 		select {
 		case csock := <-csock_chan:
+			if shutting_down {
+				csock.Close()
+				continue
+			}
 			conn := &Connection{
 				id:                nconns,
 				csock:             csock,
@@ -120,15 +242,45 @@ func main() {
 		case id := <-conn_closed_chan:
 			delete(conns, id)
 			log.Printf("%v: Handle returned", id)
+			if shutting_down && len(conns) == 0 {
+				log.Printf("All connections drained, exiting")
+				return
+			}
+		case sig := <-term_chan:
+			log.Printf("Received %v, draining %v connection(s) for up to %v",
+				sig, len(conns), shutdown_grace)
+			shutting_down = true
+			lsock.Close()
+			for _, conn := range conns {
+				conn.csock.CloseRead()
+			}
+			if len(conns) == 0 {
+				return
+			}
+			grace_chan = time.After(shutdown_grace)
+		case <-grace_chan:
+			ids := make([]int, 0, len(conns))
+			for id, conn := range conns {
+				ids = append(ids, id)
+				conn.csock.Close()
+			}
+			log.Printf("Shutdown grace period expired, forcing close of %v connection(s): %v",
+				len(conns), ids)
+			return
 		}
 	}
 }
 
-// Accepts incoming connections and passes them back through a channel
+// Accepts incoming connections and passes them back through a channel.
+// Returns once lsock is closed, e.g. by the shutdown handler in main.
 func RunAccepter(lsock *net.TCPListener, schan chan<- *net.TCPConn) {
 	for {
 		csock, err := lsock.AcceptTCP()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				log.Printf("Listen socket closed, accepter stopping")
+				return
+			}
 			log.Printf("Error accepting: %v", err)
 			continue
 		}
@@ -136,15 +288,43 @@ func RunAccepter(lsock *net.TCPListener, schan chan<- *net.TCPConn) {
 	}
 }
 
+// setReadDeadline sets conn's read deadline to d from now, or clears it if
+// d is zero.
+func setReadDeadline(conn *net.TCPConn, d time.Duration) {
+	if d <= 0 {
+		conn.SetReadDeadline(time.Time{})
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(d))
+}
+
+// setWriteDeadline sets conn's write deadline to d from now, or clears it
+// if d is zero.
+func setWriteDeadline(conn *net.TCPConn, d time.Duration) {
+	if d <= 0 {
+		conn.SetWriteDeadline(time.Time{})
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(d))
+}
+
 // Reads buffers from the client to a channel, from which its written
 // to the proxee (and possibly guardian)
 func (c *Connection) RunClientReader() {
 	defer log.Printf("%v: RunClientReader returned", c.id)
 	defer close(c.client_buffers_chan)
 
+	first := true
 	for {
+		if first {
+			setReadDeadline(c.csock, handshake_timeout)
+			first = false
+		} else {
+			setReadDeadline(c.csock, idle_timeout)
+		}
+
 		buffer := make([]byte, 2048, 2048)
-		nread, err := c.csock.Read(buffer)
+		nread, err := c.creader.Read(buffer)
 
 		if nread == 0 {
 			log.Printf("%v: No bytes read: %v", c.id, err)
@@ -164,52 +344,96 @@ func (c *Connection) RunClientReader() {
 
 // Reads the first byte send by the guardian which contains the
 // decision whether to connect the client to the proxee or guardian.
+// This is the -guardian-protocol=legacy reader; see protocol_v1.go for the
+// structured v1 equivalent.
 func (c *Connection) RunGuardianDecisionReader() {
 	defer log.Printf("%v: RunGuardianDecisionReader returned", c.id)
+	setReadDeadline(c.gsock, guardian_timeout)
 	buffer := make([]byte, 1, 1)
 	nread, err := c.gsock.Read(buffer)
 	if nread == 0 {
 		log.Printf("%v: Guardian closed connection: %v", c.id, err)
-		c.guardian_decision_chan <- GDError
+		c.guardian_decision_chan <- GuardianVerdict{kind: GDError}
 		return
 	}
 	switch buffer[0] {
 	case 103: // g
-		c.guardian_decision_chan <- GDPassToGuardian
+		c.guardian_decision_chan <- GuardianVerdict{kind: GDPassToGuardian}
 	case 112: // p
-		c.guardian_decision_chan <- GDPassToProxee
+		c.guardian_decision_chan <- GuardianVerdict{kind: GDPassToProxee}
 	default:
 		log.Printf("%v: Guardian gave unrecognized decision: %v", c.id, buffer[0])
-		c.guardian_decision_chan <- GDError
+		c.guardian_decision_chan <- GuardianVerdict{kind: GDError}
 	}
 }
 
-// Pump data from the proxee to the client
+// logSpliceMetrics logs that a pump has returned along with the running
+// totals of bytes moved via splice(2) vs. via a userspace copy, so the gain
+// from -splice can be observed in the logs.
+func logSpliceMetrics(id int, what string) {
+	spliced, copied := spliceMetrics()
+	log.Printf("%v: %v returned (splice bytes so far: %v, copy bytes so far: %v)",
+		id, what, spliced, copied)
+}
+
+// Pump data from the proxee to the client, using the splice(2) path when
+// available (see splice_linux.go / splice_other.go). Under
+// -guardian-protocol=v1 the guardian may still send a REWRITE_PROXEE
+// verdict after an earlier PASS_TO_PROXEE (see RunGuardianVerdictReader),
+// which swaps c.psock out and closes the one this pump is using; every
+// fetch of the current socket goes through proxeeSock() so that race is
+// safe, and a pump that ends because its psock was swapped out restarts
+// against the new one instead of treating that as a fatal error.
 func (c *Connection) RunProxeeToClientPump() {
-	defer log.Printf("%v: RunProxeeToClientPump returned", c.id)
+	defer logSpliceMetrics(c.id, "RunProxeeToClientPump")
 	log.Printf("%v: passing to proxee", c.id)
-	_, err := io.Copy(c.csock, c.psock)
-	if err == nil {
-		c.csock.CloseWrite()
+	for {
+		psock := c.proxeeSock()
+		err := c.pump(c.csock, psock, "proxee_to_client")
+		if err == nil {
+			c.csock.CloseWrite()
+			c.feedback_chan <- WFPumpDone
+			return
+		}
+		if c.proxeeSock() != psock {
+			log.Printf("%v: proxee was rewritten mid-pump, restarting: %v", c.id, err)
+			continue
+		}
+		log.Printf("%v: failed to pump from proxee to client: %v", c.id, err)
+		c.feedback_chan <- WFFatalError
 		return
 	}
-	log.Printf("%v: failed to pump from proxee to client: %v", c.id, err)
-	c.feedback_chan <- WFFatalError
 }
 
-// Pump data from the guardian to the client
+// Pump data from the guardian to the client, using the splice(2) path when
+// available (see splice_linux.go / splice_other.go).
 func (c *Connection) RunGuardianToClientPump() {
-	defer log.Printf("%v: RunGuardianToClientPump returned", c.id)
+	defer logSpliceMetrics(c.id, "RunGuardianToClientPump")
 	log.Printf("%v: passing to guardian", c.id)
-	_, err := io.Copy(c.csock, c.gsock)
+	err := c.pump(c.csock, c.gsock, "guardian_to_client")
 	if err == nil {
 		c.csock.CloseWrite()
+		c.feedback_chan <- WFPumpDone
 		return
 	}
 	log.Printf("%v: failed to pump from guardian to client: %v", c.id, err)
 	c.feedback_chan <- WFFatalError
 }
 
+// Pump data straight from the client to the proxee, bypassing the guardian
+// entirely. Used for routes with SkipGuardian set (see router.go).
+func (c *Connection) RunClientToProxeePump() {
+	defer logSpliceMetrics(c.id, "RunClientToProxeePump")
+	err := c.pump(c.psock, c.csock, "client_to_proxee")
+	if err == nil {
+		c.psock.CloseWrite()
+		c.feedback_chan <- WFPumpDone
+		return
+	}
+	log.Printf("%v: failed to pump from client to proxee: %v", c.id, err)
+	c.feedback_chan <- WFFatalError
+}
+
 // Write data read from client to guardian and proxee
 func (c *Connection) RunWriter() {
 	defer log.Printf("%v: RunWriter returned", c.id)
@@ -219,38 +443,181 @@ func (c *Connection) RunWriter() {
 			break
 		}
 
-		offset := 0
-		for c.write_to_guardian && offset != len(buffer) {
-			nwritten, err := c.gsock.Write(buffer[offset:len(buffer)])
-			if err != nil {
-				log.Printf("%v: Failed to write to guardian: %v", c.id, err)
+		if c.write_to_guardian {
+			setWriteDeadline(c.gsock, guardian_timeout)
+			var werr error
+			if guardian_protocol == "v1" {
+				werr = writeFrame(c.gsock, FrameClientData, buffer)
+			} else {
+				offset := 0
+				for offset != len(buffer) {
+					nwritten, err := c.gsock.Write(buffer[offset:len(buffer)])
+					if err != nil {
+						werr = err
+						break
+					}
+					offset += nwritten
+				}
+			}
+			if werr != nil {
+				log.Printf("%v: Failed to write to guardian: %v", c.id, werr)
 				c.write_to_guardian = false
 				c.feedback_chan <- WFDoNotWriteToGuardian
-				break
 			}
-			offset += nwritten
 		}
 
-		offset = 0
+		offset := 0
 		for c.write_to_proxee && offset != len(buffer) {
-			nwritten, err := c.psock.Write(buffer[offset:len(buffer)])
+			psock := c.proxeeSock()
+			setWriteDeadline(psock, idle_timeout)
+			nwritten, err := psock.Write(buffer[offset:len(buffer)])
 			if err != nil {
 				log.Printf("%v: Failed to write to proxee: %v", c.id, err)
-				return
+				c.write_to_proxee = false
+				c.feedback_chan <- WFDoNotWriteToProxee
+				break
 			}
 			offset += nwritten
 		}
 	}
 }
 
+// dialTCPTimeout dials addr, bounded by -handshake-timeout so a wedged or
+// firewalled peer can't pin the dialing goroutine (and its fd) past the
+// configured deadline; net.DialTCP itself takes no timeout. A zero
+// handshake_timeout disables the bound, matching net.Dialer's own
+// zero-value semantics.
+func dialTCPTimeout(addr *net.TCPAddr) (*net.TCPConn, error) {
+	conn, err := (&net.Dialer{Timeout: handshake_timeout}).Dial("tcp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.TCPConn), nil
+}
+
+// dialProxee dials addr and, if -send-proxy-protocol is set, immediately
+// writes a PROXY protocol header carrying c.clientAddr, so the proxee sees
+// the real client address too.
+func (c *Connection) dialProxee(addr *net.TCPAddr) (*net.TCPConn, error) {
+	psock, err := dialTCPTimeout(addr)
+	if err != nil {
+		return nil, err
+	}
+	if sendProxyProtocol != "" {
+		if err := writeProxyProtocolHeader(psock, c.clientAddr, psock.LocalAddr()); err != nil {
+			psock.Close()
+			return nil, fmt.Errorf("writing PROXY protocol header: %v", err)
+		}
+	}
+	return psock, nil
+}
+
+// rewriteProxee dials a new proxee backend in response to a
+// FrameVerdictRewriteProxee verdict (-guardian-protocol=v1 only) and swaps
+// it in for c.psock, closing the old one.
+func (c *Connection) rewriteProxee(addr string) error {
+	resolved, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return err
+	}
+	psock, err := c.dialProxee(resolved)
+	if err != nil {
+		return err
+	}
+	c.psockMu.Lock()
+	old := c.psock
+	c.psock = psock
+	c.psockMu.Unlock()
+	old.Close()
+	log.Printf("%v: Guardian rewrote proxee to %v", c.id, addr)
+	return nil
+}
+
+// haltActivePump closes whichever socket the post-pass pump started by an
+// earlier PASS_TO_PROXEE/PASS_TO_GUARDIAN is reading from, if any, and waits
+// for it to report completion. A v1 guardian may send REJECT after such a
+// pass (see RunGuardianVerdictReader); without this, the GDReject case's
+// write of the reject body to c.csock would race that pump's own writes to
+// c.csock and could land interleaved in the middle of the live stream.
+func (c *Connection) haltActivePump() {
+	switch {
+	case !c.write_to_guardian:
+		c.proxeeSock().Close()
+		<-c.feedback_chan
+	case !c.write_to_proxee:
+		c.gsock.Close()
+		<-c.feedback_chan
+	}
+}
+
+// drainPeekedToProxee forwards whatever the router sniffing peeked out of
+// c.creader to the proxee before the raw splice/io.Copy pump takes over
+// (which reads directly off c.csock and would otherwise skip those bytes).
+func (c *Connection) drainPeekedToProxee() error {
+	n := c.creader.Buffered()
+	if n == 0 {
+		return nil
+	}
+	peeked, err := c.creader.Peek(n)
+	if err != nil {
+		return err
+	}
+	if _, err := c.psock.Write(peeked); err != nil {
+		return err
+	}
+	_, err = c.creader.Discard(n)
+	return err
+}
+
 func (c *Connection) Handle() {
 	// First, connect to proxee and guardian
 	defer func() { conn_closed_chan <- c.id }()
 	defer c.csock.Close()
+	defer cleanupSplice(c.id)
+
+	c.clientAddr = c.csock.RemoteAddr()
+	if acceptProxyProtocol {
+		addr, err := readProxyProtocolHeader(c.csock)
+		if err != nil {
+			log.Printf("%v: Failed to read PROXY protocol header: %v", c.id, err)
+			return
+		}
+		if addr != nil {
+			c.clientAddr = addr
+		}
+	}
+
+	log.Printf("%v: New connection from %v", c.id, c.clientAddr)
+	c.creader = bufio.NewReaderSize(c.csock, sniffBufferSize)
+
+	proxeeAddr := res_proxee_addr
+	guardianAddr := res_guardian_addr
+	skipGuardian := false
+
+	if router, _ := currentRouter.Load().(*Router); router != nil {
+		// resolveRoute peeks off c.csock without ever reading via
+		// RunClientReader (which doesn't start until after the proxee is
+		// dialed), so it needs its own -handshake-timeout bound; otherwise
+		// a client that sends a short prefix and then goes silent pins
+		// this goroutine and its fds indefinitely.
+		setReadDeadline(c.csock, handshake_timeout)
+		route, err := c.resolveRoute(router)
+		setReadDeadline(c.csock, 0)
+		if err != nil {
+			log.Printf("%v: No route matched: %v", c.id, err)
+			return
+		}
+		c.route = route
+		proxeeAddr = route.resolvedBackend
+		if route.resolvedGuardian != nil {
+			guardianAddr = route.resolvedGuardian
+		}
+		skipGuardian = route.SkipGuardian
+		log.Printf("%v: Matched route %q, backend %v", c.id, route.Name, proxeeAddr)
+	}
 
-	log.Printf("%v: New connection from %v", c.id, c.csock.RemoteAddr())
 	log.Printf("%v: Connecting to proxee", c.id)
-	psock, err := net.DialTCP("tcp", nil, res_proxee_addr)
+	psock, err := c.dialProxee(proxeeAddr)
 	if err != nil {
 		log.Printf("%v: Failed to connect to proxee: %v", c.id, err)
 		return
@@ -258,7 +625,25 @@ func (c *Connection) Handle() {
 	c.psock = psock
 	defer c.psock.Close()
 
-	gsock, err := net.DialTCP("tcp", nil, res_guardian_addr)
+	if skipGuardian {
+		log.Printf("%v: route %q bypasses the guardian", c.id, c.route.Name)
+		c.feedback_chan = make(chan WorkerFeedback, 2)
+		if err := c.drainPeekedToProxee(); err != nil {
+			log.Printf("%v: Failed to forward peeked bytes to proxee: %v", c.id, err)
+			return
+		}
+		go c.RunClientToProxeePump()
+		go c.RunProxeeToClientPump()
+		// Both pumps always post exactly one message, success or failure
+		// (see WFPumpDone), so waiting for two messages here can't block
+		// forever even when both directions close out cleanly.
+		for i := 0; i < 2; i++ {
+			<-c.feedback_chan
+		}
+		return
+	}
+
+	gsock, err := dialTCPTimeout(guardianAddr)
 	if err != nil {
 		log.Printf("%v: Failed to connect to guardian: %v", c.id, err)
 		return
@@ -270,29 +655,60 @@ func (c *Connection) Handle() {
 
 	// NOTE there can be at most five feedback messages send to the feedback_chan
 	c.feedback_chan = make(chan WorkerFeedback, 5)
-	c.guardian_decision_chan = make(chan GuardianDecision)
+	c.guardian_decision_chan = make(chan GuardianVerdict)
 	c.client_buffers_chan = make(chan []byte)
 
 	// Start the workers
 
 	go c.RunClientReader()
-	go c.RunGuardianDecisionReader()
+	if guardian_protocol == "v1" {
+		setWriteDeadline(c.gsock, guardian_timeout)
+		if err := writeHandshake(c.gsock, c); err != nil {
+			log.Printf("%v: Failed to write guardian handshake: %v", c.id, err)
+			return
+		}
+		go c.RunGuardianVerdictReader()
+	} else {
+		go c.RunGuardianDecisionReader()
+	}
 	go c.RunWriter()
 
 	for {
 		select {
 		case what := <-c.guardian_decision_chan:
-			switch what {
+			switch what.kind {
 			case GDError:
 				return
 			case GDPassToProxee:
-				c.write_to_guardian = false
-				c.gsock.Close()
-				go c.RunProxeeToClientPump()
+				// Guard against a guardian re-sending PASS_TO_PROXEE: under
+				// v1 the verdict reader keeps running after a pass (see
+				// RunGuardianVerdictReader) so it can later force-close
+				// with a REJECT, and c.gsock must stay open for that.
+				if c.write_to_guardian {
+					c.write_to_guardian = false
+					if guardian_protocol != "v1" {
+						c.gsock.Close()
+					}
+					go c.RunProxeeToClientPump()
+				}
 			case GDPassToGuardian:
-				c.write_to_proxee = false
-				c.psock.Close()
-				go c.RunGuardianToClientPump()
+				if c.write_to_proxee {
+					c.write_to_proxee = false
+					c.psock.Close()
+					go c.RunGuardianToClientPump()
+				}
+			case GDReject:
+				log.Printf("%v: Guardian rejected connection (code %v)", c.id, what.code)
+				c.haltActivePump()
+				if len(what.body) > 0 {
+					c.csock.Write(what.body)
+				}
+				return
+			case GDRewriteProxee:
+				if err := c.rewriteProxee(what.addr); err != nil {
+					log.Printf("%v: Failed to rewrite proxee to %v: %v", c.id, what.addr, err)
+					return
+				}
 			}
 
 		case what := <-c.feedback_chan:
@@ -301,6 +717,12 @@ func (c *Connection) Handle() {
 				return
 			case WFDoNotWriteToGuardian:
 				c.write_to_guardian = false
+			case WFDoNotWriteToProxee:
+				c.write_to_proxee = false
+			case WFPumpDone:
+				// The post-decision pump closed out cleanly; nothing to do
+				// here; this path's own exit is still driven by the
+				// feedback above and the flag check below.
 			}
 		}
 		if !c.write_to_proxee && !c.write_to_guardian {
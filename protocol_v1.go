@@ -0,0 +1,201 @@
+// (c) 2017 - Bas Westerbaan <bas@westerbaan.name>
+// You may redistribute this file under the conditions of the GPLv3.
+
+// This file implements -guardian-protocol=v1: a length-prefixed, versioned
+// framing that gives the guardian proper metadata about a connection
+// (instead of just raw client bytes) and lets it reply with a stream of
+// typed verdicts instead of a single decision byte.
+//
+// Wire format, all integers big-endian:
+//
+//	magic    4 bytes, "CHP1"
+//	version  1 byte, currently 1
+//	frame*   zero or more frames, see below
+//
+// A frame is:
+//
+//	type     1 byte
+//	length   4 bytes
+//	payload  length bytes
+//
+// chaperoned writes a single FrameHandshake right after connecting to the
+// guardian, describing the connection, followed by a FrameClientData frame
+// for every buffer mirrored from the client. The guardian replies with a
+// stream of verdict frames (FrameVerdict*).
+//
+// The FrameHandshake payload is itself a sequence of TLVs (1-byte tag,
+// 2-byte length, value): tlvClientAddr, tlvListenAddr, tlvProxeeAddr,
+// tlvTimestamp (8-byte unix nanoseconds) and tlvConnID (4-byte connection
+// id).
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+var protocolMagic = [4]byte{'C', 'H', 'P', '1'}
+
+const protocolVersion1 = 1
+
+// maxFrameLength bounds the payload readFrame will allocate for a single
+// frame, so a misbehaving or compromised guardian can't force an
+// arbitrarily large allocation just by sending a large length prefix. 1 MiB
+// comfortably covers a FrameHandshake or FrameVerdictReject body; client
+// data is chunked to 2048 bytes per RunClientReader anyway.
+const maxFrameLength = 1 << 20
+
+// FrameType identifies the payload that follows a frame header.
+type FrameType uint8
+
+const (
+	FrameHandshake FrameType = iota + 1
+	FrameClientData
+	FrameVerdictPassToProxee
+	FrameVerdictPassToGuardian
+	FrameVerdictReject
+	FrameVerdictRewriteProxee
+	FrameVerdictContinue
+)
+
+// tlvTag identifies a field inside a FrameHandshake payload.
+type tlvTag uint8
+
+const (
+	tlvClientAddr tlvTag = iota + 1
+	tlvListenAddr
+	tlvProxeeAddr
+	tlvTimestamp
+	tlvConnID
+	tlvRouteName // present iff the connection was matched against a Route
+)
+
+// writeFrame writes a single frame (1-byte type, 4-byte length, payload) to w.
+func writeFrame(w io.Writer, typ FrameType, payload []byte) error {
+	var header [5]byte
+	header[0] = byte(typ)
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	if len(payload) == 0 {
+		return nil
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// readFrame reads a single frame from r.
+func readFrame(r io.Reader) (FrameType, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > maxFrameLength {
+		return 0, nil, fmt.Errorf("frame length %v exceeds maximum %v", length, maxFrameLength)
+	}
+	payload := make([]byte, length)
+	if len(payload) > 0 {
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return 0, nil, err
+		}
+	}
+	return FrameType(header[0]), payload, nil
+}
+
+// putTLV appends a tag + 2-byte-length-prefixed value to buf.
+func putTLV(buf *bytes.Buffer, tag tlvTag, value []byte) {
+	buf.WriteByte(byte(tag))
+	var length [2]byte
+	binary.BigEndian.PutUint16(length[:], uint16(len(value)))
+	buf.Write(length[:])
+	buf.Write(value)
+}
+
+// writeHandshake writes the magic, version and the FrameHandshake that
+// introduces a connection to the guardian.
+func writeHandshake(w io.Writer, c *Connection) error {
+	var buf bytes.Buffer
+	putTLV(&buf, tlvClientAddr, []byte(c.clientAddr.String()))
+	putTLV(&buf, tlvListenAddr, []byte(listen_addr))
+	putTLV(&buf, tlvProxeeAddr, []byte(proxee_addr))
+
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(time.Now().UnixNano()))
+	putTLV(&buf, tlvTimestamp, ts[:])
+
+	var id [4]byte
+	binary.BigEndian.PutUint32(id[:], uint32(c.id))
+	putTLV(&buf, tlvConnID, id[:])
+
+	if c.route != nil {
+		putTLV(&buf, tlvRouteName, []byte(c.route.Name))
+	}
+
+	if _, err := w.Write(protocolMagic[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte{protocolVersion1}); err != nil {
+		return err
+	}
+	return writeFrame(w, FrameHandshake, buf.Bytes())
+}
+
+// readVerdict reads and decodes a single verdict frame from the guardian.
+func readVerdict(r io.Reader) (GuardianVerdict, error) {
+	typ, payload, err := readFrame(r)
+	if err != nil {
+		return GuardianVerdict{}, err
+	}
+	switch typ {
+	case FrameVerdictPassToProxee:
+		return GuardianVerdict{kind: GDPassToProxee}, nil
+	case FrameVerdictPassToGuardian:
+		return GuardianVerdict{kind: GDPassToGuardian}, nil
+	case FrameVerdictContinue:
+		return GuardianVerdict{kind: GDContinue}, nil
+	case FrameVerdictReject:
+		if len(payload) < 1 {
+			return GuardianVerdict{}, fmt.Errorf("short REJECT frame")
+		}
+		return GuardianVerdict{kind: GDReject, code: payload[0], body: payload[1:]}, nil
+	case FrameVerdictRewriteProxee:
+		return GuardianVerdict{kind: GDRewriteProxee, addr: string(payload)}, nil
+	default:
+		return GuardianVerdict{}, fmt.Errorf("unrecognized verdict frame type %v", typ)
+	}
+}
+
+// RunGuardianVerdictReader is the -guardian-protocol=v1 counterpart of
+// RunGuardianDecisionReader: it reads a stream of verdict frames from the
+// guardian. A CONTINUE verdict is swallowed so the guardian can keep
+// watching traffic before deciding; every other verdict is forwarded to
+// guardian_decision_chan. Only REJECT (or a read error) ends the stream:
+// PASS_TO_PROXEE, PASS_TO_GUARDIAN and REWRITE_PROXEE all leave the
+// guardian socket and this reader running, so a guardian that has already
+// passed a connection can keep watching it and force-close later with a
+// REJECT.
+func (c *Connection) RunGuardianVerdictReader() {
+	defer log.Printf("%v: RunGuardianVerdictReader returned", c.id)
+	for {
+		setReadDeadline(c.gsock, guardian_timeout)
+		v, err := readVerdict(c.gsock)
+		if err != nil {
+			log.Printf("%v: Failed to read verdict from guardian: %v", c.id, err)
+			c.guardian_decision_chan <- GuardianVerdict{kind: GDError}
+			return
+		}
+		if v.kind == GDContinue {
+			continue
+		}
+		c.guardian_decision_chan <- v
+		if v.kind == GDReject {
+			return
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// (c) 2017 - Bas Westerbaan <bas@westerbaan.name>
+// You may redistribute this file under the conditions of the GPLv3.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteReadFrame(t *testing.T) {
+	cases := []struct {
+		typ     FrameType
+		payload []byte
+	}{
+		{FrameClientData, nil},
+		{FrameClientData, []byte("hello")},
+		{FrameVerdictPassToProxee, nil},
+		{FrameVerdictReject, []byte{42, 'n', 'o'}},
+	}
+	for _, c := range cases {
+		var buf bytes.Buffer
+		if err := writeFrame(&buf, c.typ, c.payload); err != nil {
+			t.Fatalf("writeFrame(%v, %q): %v", c.typ, c.payload, err)
+		}
+		typ, payload, err := readFrame(&buf)
+		if err != nil {
+			t.Fatalf("readFrame after writeFrame(%v, %q): %v", c.typ, c.payload, err)
+		}
+		if typ != c.typ {
+			t.Errorf("type: got %v, want %v", typ, c.typ)
+		}
+		if len(c.payload) == 0 {
+			if len(payload) != 0 {
+				t.Errorf("payload: got %q, want empty", payload)
+			}
+		} else if !bytes.Equal(payload, c.payload) {
+			t.Errorf("payload: got %q, want %q", payload, c.payload)
+		}
+	}
+}
+
+func TestReadFrameRejectsOversizedLength(t *testing.T) {
+	var header [5]byte
+	header[0] = byte(FrameClientData)
+	header[1], header[2], header[3], header[4] = 0x7F, 0xFF, 0xFF, 0xFF // far past maxFrameLength
+	_, _, err := readFrame(bytes.NewReader(header[:]))
+	if err == nil {
+		t.Fatalf("readFrame accepted a length of 0x7FFFFFFF, want an error")
+	}
+}
+
+func TestReadVerdict(t *testing.T) {
+	cases := []struct {
+		name string
+		typ  FrameType
+		body []byte
+		want GuardianVerdict
+	}{
+		{"pass to proxee", FrameVerdictPassToProxee, nil, GuardianVerdict{kind: GDPassToProxee}},
+		{"pass to guardian", FrameVerdictPassToGuardian, nil, GuardianVerdict{kind: GDPassToGuardian}},
+		{"continue", FrameVerdictContinue, nil, GuardianVerdict{kind: GDContinue}},
+		{"reject with body", FrameVerdictReject, append([]byte{7}, "go away"...),
+			GuardianVerdict{kind: GDReject, code: 7, body: []byte("go away")}},
+		{"rewrite proxee", FrameVerdictRewriteProxee, []byte("10.0.0.1:80"),
+			GuardianVerdict{kind: GDRewriteProxee, addr: "10.0.0.1:80"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeFrame(&buf, c.typ, c.body); err != nil {
+				t.Fatalf("writeFrame: %v", err)
+			}
+			got, err := readVerdict(&buf)
+			if err != nil {
+				t.Fatalf("readVerdict: %v", err)
+			}
+			if got.kind != c.want.kind || got.code != c.want.code ||
+				got.addr != c.want.addr || !bytes.Equal(got.body, c.want.body) {
+				t.Errorf("readVerdict = %+v, want %+v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestReadVerdictShortReject(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeFrame(&buf, FrameVerdictReject, nil); err != nil {
+		t.Fatalf("writeFrame: %v", err)
+	}
+	if _, err := readVerdict(&buf); err == nil {
+		t.Fatalf("readVerdict accepted a REJECT frame with no code byte")
+	}
+}
+
+func TestWriteHandshake(t *testing.T) {
+	c := &Connection{id: 7, clientAddr: mustAddr(t, "1.2.3.4:5678")}
+	var buf bytes.Buffer
+	if err := writeHandshake(&buf, c); err != nil {
+		t.Fatalf("writeHandshake: %v", err)
+	}
+	var magic [4]byte
+	if _, err := buf.Read(magic[:]); err != nil || magic != protocolMagic {
+		t.Fatalf("magic = %q, %v; want %q", magic, err, protocolMagic)
+	}
+	version, err := buf.ReadByte()
+	if err != nil || version != protocolVersion1 {
+		t.Fatalf("version = %v, %v; want %v", version, err, protocolVersion1)
+	}
+	typ, payload, err := readFrame(&buf)
+	if err != nil {
+		t.Fatalf("readFrame: %v", err)
+	}
+	if typ != FrameHandshake {
+		t.Errorf("frame type = %v, want FrameHandshake", typ)
+	}
+	if !bytes.Contains(payload, []byte("1.2.3.4:5678")) {
+		t.Errorf("handshake payload %q does not contain the client address", payload)
+	}
+}
+
+func mustAddr(t *testing.T, s string) addrStringer {
+	t.Helper()
+	return addrStringer(s)
+}
+
+// addrStringer is a minimal net.Addr for tests that only need String().
+type addrStringer string
+
+func (a addrStringer) Network() string { return "tcp" }
+func (a addrStringer) String() string  { return string(a) }
@@ -0,0 +1,247 @@
+// (c) 2017 - Bas Westerbaan <bas@westerbaan.name>
+// You may redistribute this file under the conditions of the GPLv3.
+
+// This file implements the HAProxy PROXY protocol (v1 text and v2 binary),
+// used to preserve the real client address across an L4 load balancer
+// (HAProxy, AWS NLB) that would otherwise make chaperoned itself look like
+// the client to both the proxee and the guardian.
+//
+// -accept-proxy-protocol makes Connection.Handle read and parse a PROXY
+// header off csock before any bytes are mirrored to the guardian, and use
+// the address it carries (c.clientAddr) in logs and in the guardian v1
+// handshake instead of csock's real peer address. -send-proxy-protocol
+// writes the equivalent header to the proxee immediately after dialing it
+// (see dialProxee in main.go), so the proxee sees the real client too.
+//
+// See https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// acceptProxyProtocol is -accept-proxy-protocol.
+var acceptProxyProtocol bool
+
+// sendProxyProtocol is -send-proxy-protocol: "" (disabled), "v1" or "v2".
+var sendProxyProtocol string
+
+// proxyProtocolV2Sig is the fixed 12-byte signature that opens a v2 header.
+var proxyProtocolV2Sig = [12]byte{
+	0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A,
+}
+
+// maxProxyProtocolV1Len bounds a v1 header line, per spec the longest
+// possible line ("PROXY TCP6 " plus two IPv6 addresses and two ports) fits
+// in 107 bytes including the trailing CRLF.
+const maxProxyProtocolV1Len = 107
+
+// readProxyProtocolHeader reads and parses a PROXY protocol header (v1 or
+// v2) off conn, consuming exactly the header and nothing past it. A nil
+// address with a nil error means the header was well-formed but carried no
+// usable client address (PROXY UNKNOWN, or a v2 LOCAL command), so the
+// caller should keep using conn's own peer address.
+func readProxyProtocolHeader(conn *net.TCPConn) (net.Addr, error) {
+	setReadDeadline(conn, handshake_timeout)
+	defer setReadDeadline(conn, 0)
+
+	var first [1]byte
+	if _, err := io.ReadFull(conn, first[:]); err != nil {
+		return nil, fmt.Errorf("reading PROXY protocol header: %v", err)
+	}
+
+	switch first[0] {
+	case proxyProtocolV2Sig[0]:
+		return readProxyProtocolV2(conn, first[0])
+	case 'P':
+		return readProxyProtocolV1(conn, first[0])
+	default:
+		return nil, fmt.Errorf("unrecognized PROXY protocol signature byte %#x", first[0])
+	}
+}
+
+// readProxyProtocolV1 reads the rest of a v1 text header, one byte at a
+// time (the header is at most maxProxyProtocolV1Len bytes, so this is not
+// worth buffering), and parses it.
+func readProxyProtocolV1(conn *net.TCPConn, first byte) (net.Addr, error) {
+	line := make([]byte, 1, maxProxyProtocolV1Len)
+	line[0] = first
+	var b [1]byte
+	for {
+		if len(line) >= maxProxyProtocolV1Len {
+			return nil, fmt.Errorf("PROXY v1 header exceeds %v bytes", maxProxyProtocolV1Len)
+		}
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			return nil, fmt.Errorf("reading PROXY v1 header: %v", err)
+		}
+		line = append(line, b[0])
+		if len(line) >= 2 && line[len(line)-2] == '\r' && line[len(line)-1] == '\n' {
+			break
+		}
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("malformed PROXY v1 header %q", line)
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("malformed PROXY v1 %v header %q", fields[1], line)
+		}
+		ip := net.ParseIP(fields[2])
+		if ip == nil {
+			return nil, fmt.Errorf("malformed PROXY v1 source address %q", fields[2])
+		}
+		port, err := strconv.Atoi(fields[4])
+		if err != nil {
+			return nil, fmt.Errorf("malformed PROXY v1 source port %q", fields[4])
+		}
+		return &net.TCPAddr{IP: ip, Port: port}, nil
+	default:
+		return nil, fmt.Errorf("unknown PROXY v1 protocol %q", fields[1])
+	}
+}
+
+// readProxyProtocolV2 reads the rest of a v2 binary header: the remaining
+// 11 signature bytes, the 4-byte ver_cmd/fam_proto/length header and the
+// address block it names.
+func readProxyProtocolV2(conn *net.TCPConn, first byte) (net.Addr, error) {
+	var rest [11]byte
+	if _, err := io.ReadFull(conn, rest[:]); err != nil {
+		return nil, fmt.Errorf("reading PROXY v2 signature: %v", err)
+	}
+	var sig [12]byte
+	sig[0] = first
+	copy(sig[1:], rest[:])
+	if sig != proxyProtocolV2Sig {
+		return nil, fmt.Errorf("bad PROXY v2 signature")
+	}
+
+	var hdr [4]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return nil, fmt.Errorf("reading PROXY v2 header: %v", err)
+	}
+	verCmd, famProto := hdr[0], hdr[1]
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY v2 version %v", verCmd>>4)
+	}
+	cmd := verCmd & 0x0F
+	length := binary.BigEndian.Uint16(hdr[2:])
+
+	addr := make([]byte, length)
+	if length > 0 {
+		if _, err := io.ReadFull(conn, addr); err != nil {
+			return nil, fmt.Errorf("reading PROXY v2 address block: %v", err)
+		}
+	}
+
+	if cmd == 0x0 {
+		// LOCAL: e.g. a health check from the load balancer itself; ignore
+		// the address block and keep the connection's own socket addresses.
+		return nil, nil
+	}
+	if cmd != 0x1 {
+		return nil, fmt.Errorf("unknown PROXY v2 command %v", cmd)
+	}
+
+	switch famProto >> 4 {
+	case 0x1: // AF_INET
+		if len(addr) < 12 {
+			return nil, fmt.Errorf("short PROXY v2 AF_INET address block")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(addr[0:4]),
+			Port: int(binary.BigEndian.Uint16(addr[8:10])),
+		}, nil
+	case 0x2: // AF_INET6
+		if len(addr) < 36 {
+			return nil, fmt.Errorf("short PROXY v2 AF_INET6 address block")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(addr[0:16]),
+			Port: int(binary.BigEndian.Uint16(addr[32:34])),
+		}, nil
+	default:
+		// AF_UNSPEC or AF_UNIX: nothing we can turn into a *net.TCPAddr.
+		return nil, nil
+	}
+}
+
+// writeProxyProtocolHeader writes a -send-proxy-protocol header for
+// clientAddr (the address the client connected from, possibly itself
+// decoded from an inbound PROXY header) connecting to localAddr, to conn.
+// It is a no-op when -send-proxy-protocol is unset.
+func writeProxyProtocolHeader(conn *net.TCPConn, clientAddr, localAddr net.Addr) error {
+	switch sendProxyProtocol {
+	case "v1":
+		return writeProxyProtocolV1(conn, clientAddr, localAddr)
+	case "v2":
+		return writeProxyProtocolV2(conn, clientAddr, localAddr)
+	default:
+		return nil
+	}
+}
+
+func writeProxyProtocolV1(conn *net.TCPConn, clientAddr, localAddr net.Addr) error {
+	cAddr, cOK := clientAddr.(*net.TCPAddr)
+	lAddr, lOK := localAddr.(*net.TCPAddr)
+	if !cOK || !lOK {
+		_, err := conn.Write([]byte("PROXY UNKNOWN\r\n"))
+		return err
+	}
+	family := "TCP4"
+	if cAddr.IP.To4() == nil {
+		family = "TCP6"
+	}
+	_, err := fmt.Fprintf(conn, "PROXY %v %v %v %v %v\r\n",
+		family, cAddr.IP.String(), lAddr.IP.String(), cAddr.Port, lAddr.Port)
+	return err
+}
+
+func writeProxyProtocolV2(conn *net.TCPConn, clientAddr, localAddr net.Addr) error {
+	cAddr, cOK := clientAddr.(*net.TCPAddr)
+	lAddr, lOK := localAddr.(*net.TCPAddr)
+
+	header := append([]byte{}, proxyProtocolV2Sig[:]...)
+
+	if !cOK || !lOK {
+		// LOCAL: nothing usable to carry, e.g. the client addr is a Unix
+		// socket or otherwise not a *net.TCPAddr.
+		header = append(header, 0x20, 0x00, 0x00, 0x00)
+		_, err := conn.Write(header)
+		return err
+	}
+
+	var addr []byte
+	if v4 := cAddr.IP.To4(); v4 != nil {
+		addr = make([]byte, 12)
+		copy(addr[0:4], v4)
+		copy(addr[4:8], lAddr.IP.To4())
+		binary.BigEndian.PutUint16(addr[8:10], uint16(cAddr.Port))
+		binary.BigEndian.PutUint16(addr[10:12], uint16(lAddr.Port))
+		header = append(header, 0x21, 0x11) // version 2, PROXY; AF_INET, STREAM
+	} else {
+		addr = make([]byte, 36)
+		copy(addr[0:16], cAddr.IP.To16())
+		copy(addr[16:32], lAddr.IP.To16())
+		binary.BigEndian.PutUint16(addr[32:34], uint16(cAddr.Port))
+		binary.BigEndian.PutUint16(addr[34:36], uint16(lAddr.Port))
+		header = append(header, 0x21, 0x21) // version 2, PROXY; AF_INET6, STREAM
+	}
+	var length [2]byte
+	binary.BigEndian.PutUint16(length[:], uint16(len(addr)))
+	header = append(header, length[:]...)
+	header = append(header, addr...)
+
+	_, err := conn.Write(header)
+	return err
+}
@@ -0,0 +1,155 @@
+// (c) 2017 - Bas Westerbaan <bas@westerbaan.name>
+// You may redistribute this file under the conditions of the GPLv3.
+
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+// tcpConnPair dials a loopback TCP connection and returns both ends as
+// *net.TCPConn, since the PROXY protocol functions under test work on the
+// concrete type rather than the net.Conn interface.
+func tcpConnPair(t *testing.T) (client, server *net.TCPConn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		accepted <- conn
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	s := <-accepted
+	t.Cleanup(func() { s.Close() })
+
+	return c.(*net.TCPConn), s.(*net.TCPConn)
+}
+
+func TestProxyProtocolV1RoundTrip(t *testing.T) {
+	sendProxyProtocol = "v1"
+	defer func() { sendProxyProtocol = "" }()
+
+	client, server := tcpConnPair(t)
+	clientAddr := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 1234}
+	localAddr := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 80}
+
+	if err := writeProxyProtocolHeader(client, clientAddr, localAddr); err != nil {
+		t.Fatalf("writeProxyProtocolHeader: %v", err)
+	}
+
+	addr, err := readProxyProtocolHeader(server)
+	if err != nil {
+		t.Fatalf("readProxyProtocolHeader: %v", err)
+	}
+	got, ok := addr.(*net.TCPAddr)
+	if !ok {
+		t.Fatalf("addr = %T, want *net.TCPAddr", addr)
+	}
+	if !got.IP.Equal(clientAddr.IP) || got.Port != clientAddr.Port {
+		t.Errorf("addr = %v, want %v", got, clientAddr)
+	}
+}
+
+func TestProxyProtocolV2RoundTrip(t *testing.T) {
+	for _, family := range []string{"v4", "v6"} {
+		t.Run(family, func(t *testing.T) {
+			sendProxyProtocol = "v2"
+			defer func() { sendProxyProtocol = "" }()
+
+			client, server := tcpConnPair(t)
+			var clientAddr, localAddr *net.TCPAddr
+			if family == "v4" {
+				clientAddr = &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 1234}
+				localAddr = &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 80}
+			} else {
+				clientAddr = &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 1234}
+				localAddr = &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 80}
+			}
+
+			if err := writeProxyProtocolHeader(client, clientAddr, localAddr); err != nil {
+				t.Fatalf("writeProxyProtocolHeader: %v", err)
+			}
+
+			addr, err := readProxyProtocolHeader(server)
+			if err != nil {
+				t.Fatalf("readProxyProtocolHeader: %v", err)
+			}
+			got, ok := addr.(*net.TCPAddr)
+			if !ok {
+				t.Fatalf("addr = %T, want *net.TCPAddr", addr)
+			}
+			if !got.IP.Equal(clientAddr.IP) || got.Port != clientAddr.Port {
+				t.Errorf("addr = %v, want %v", got, clientAddr)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolV1Unknown(t *testing.T) {
+	client, server := tcpConnPair(t)
+	if _, err := client.Write([]byte("PROXY UNKNOWN\r\n")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	addr, err := readProxyProtocolHeader(server)
+	if err != nil {
+		t.Fatalf("readProxyProtocolHeader: %v", err)
+	}
+	if addr != nil {
+		t.Errorf("addr = %v, want nil for PROXY UNKNOWN", addr)
+	}
+}
+
+func TestProxyProtocolV1Malformed(t *testing.T) {
+	client, server := tcpConnPair(t)
+	if _, err := client.Write([]byte("PROXY GARBAGE\r\n")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err := readProxyProtocolHeader(server); err == nil {
+		t.Fatalf("readProxyProtocolHeader accepted a malformed v1 header")
+	}
+}
+
+func TestProxyProtocolV2Local(t *testing.T) {
+	client, server := tcpConnPair(t)
+	header := append([]byte{}, proxyProtocolV2Sig[:]...)
+	header = append(header, 0x20, 0x00, 0x00, 0x00) // version 2, LOCAL; AF_UNSPEC, length 0
+	if _, err := client.Write(header); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	addr, err := readProxyProtocolHeader(server)
+	if err != nil {
+		t.Fatalf("readProxyProtocolHeader: %v", err)
+	}
+	if addr != nil {
+		t.Errorf("addr = %v, want nil for a v2 LOCAL command", addr)
+	}
+}
+
+func TestProxyProtocolV2BadSignature(t *testing.T) {
+	client, server := tcpConnPair(t)
+	header := append([]byte{}, proxyProtocolV2Sig[:]...)
+	header[11] = 0x00 // corrupt the last signature byte
+	header = append(header, 0x21, 0x11, 0x00, 0x0C)
+	if _, err := client.Write(header); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err := readProxyProtocolHeader(server); err == nil {
+		t.Fatalf("readProxyProtocolHeader accepted a corrupted v2 signature")
+	}
+}
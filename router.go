@@ -0,0 +1,188 @@
+// (c) 2017 - Bas Westerbaan <bas@westerbaan.name>
+// You may redistribute this file under the conditions of the GPLv3.
+
+// This file implements -routes: a routing table that turns the single
+// -proxee backend into a small gateway, picking a backend per connection
+// based on TLS SNI, HTTP Host header, client CIDR or a literal prefix match
+// on the first bytes sent. The guardian is still consulted per the normal
+// chaperone flow, unless the matched route sets SkipGuardian.
+//
+// The table is loaded from a JSON file of the form:
+//
+//	{
+//	  "routes": [
+//	    {"name": "api", "host": "api.example.com", "backend": "10.0.0.1:8080"},
+//	    {"name": "internal", "cidr": "10.0.0.0/8", "backend": "10.0.0.2:8080",
+//	     "skip_guardian": true}
+//	  ],
+//	  "default": {"name": "fallback", "backend": "10.0.0.3:8080"}
+//	}
+//
+// and reloaded on SIGHUP without dropping connections already in flight
+// (see reloadRouter in main.go).
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync/atomic"
+)
+
+// Route describes a single routing rule. Exactly one of SNI, Host, CIDR or
+// Prefix should be set, to select which property of the connection it
+// matches against; a Route with none of those set can only be used as the
+// wildcard default.
+type Route struct {
+	Name         string `json:"name"`
+	SNI          string `json:"sni,omitempty"`
+	Host         string `json:"host,omitempty"`
+	CIDR         string `json:"cidr,omitempty"`
+	Prefix       string `json:"prefix,omitempty"`
+	Backend      string `json:"backend"`
+	Guardian     string `json:"guardian,omitempty"`      // overrides -guardian for this route
+	SkipGuardian bool   `json:"skip_guardian,omitempty"` // bypass the guardian entirely
+
+	resolvedBackend  *net.TCPAddr
+	resolvedGuardian *net.TCPAddr
+	parsedCIDR       *net.IPNet
+}
+
+// resolve resolves and validates the addresses named by a Route, so that
+// Handle never has to fail on a bad route mid-connection.
+func (route *Route) resolve() error {
+	addr, err := net.ResolveTCPAddr("tcp", route.Backend)
+	if err != nil {
+		return fmt.Errorf("backend %v: %v", route.Backend, err)
+	}
+	route.resolvedBackend = addr
+
+	if route.Guardian != "" {
+		gaddr, err := net.ResolveTCPAddr("tcp", route.Guardian)
+		if err != nil {
+			return fmt.Errorf("guardian %v: %v", route.Guardian, err)
+		}
+		route.resolvedGuardian = gaddr
+	}
+
+	if route.CIDR != "" {
+		_, ipnet, err := net.ParseCIDR(route.CIDR)
+		if err != nil {
+			return fmt.Errorf("cidr %v: %v", route.CIDR, err)
+		}
+		route.parsedCIDR = ipnet
+	}
+	return nil
+}
+
+// matches reports whether this route applies to a connection with the
+// given sniffed properties.
+func (route *Route) matches(clientIP net.IP, sni, host string, prefix []byte) bool {
+	switch {
+	case route.SNI != "":
+		return sni != "" && route.SNI == sni
+	case route.Host != "":
+		return host != "" && route.Host == host
+	case route.CIDR != "":
+		return route.parsedCIDR != nil && clientIP != nil && route.parsedCIDR.Contains(clientIP)
+	case route.Prefix != "":
+		return bytes.HasPrefix(prefix, []byte(route.Prefix))
+	}
+	return false
+}
+
+// RouterConfig is the on-disk (JSON) representation of a Router.
+type RouterConfig struct {
+	Routes  []*Route `json:"routes"`
+	Default *Route   `json:"default"`
+}
+
+// Router matches connections against a routing table loaded from disk. A
+// nil *Router (the zero value of currentRouter) means routing is disabled
+// and Handle falls back to the single -proxee backend.
+type Router struct {
+	routes  []*Route
+	deflt   *Route
+	sources string // path the table was loaded from, for logging
+}
+
+// routerConfigPath is -routes; empty means routing is disabled.
+var routerConfigPath string
+
+// currentRouter holds the active *Router, swapped atomically by
+// reloadRouter so in-flight connections keep using the Router (and Routes)
+// they were matched against.
+var currentRouter atomic.Value
+
+// LoadRouterConfig reads and resolves a routing table from a JSON file.
+func LoadRouterConfig(path string) (*Router, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg RouterConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing %v: %v", path, err)
+	}
+
+	r := &Router{deflt: cfg.Default, sources: path}
+	for _, route := range cfg.Routes {
+		if err := route.resolve(); err != nil {
+			return nil, fmt.Errorf("route %q: %v", route.Name, err)
+		}
+		r.routes = append(r.routes, route)
+	}
+	if r.deflt != nil {
+		if err := r.deflt.resolve(); err != nil {
+			return nil, fmt.Errorf("default route: %v", err)
+		}
+	}
+	return r, nil
+}
+
+// Resolve picks the first matching route in file order, falling back to
+// the configured default route. Returns nil if nothing matches and no
+// default route is configured.
+func (r *Router) Resolve(clientIP net.IP, sni, host string, prefix []byte) *Route {
+	for _, route := range r.routes {
+		if route.matches(clientIP, sni, host, prefix) {
+			return route
+		}
+	}
+	return r.deflt
+}
+
+// reloadRouter (re)loads the routing table named by -routes and, on
+// success, swaps it into currentRouter. It is called once at startup and
+// again on every SIGHUP.
+func reloadRouter() {
+	router, err := LoadRouterConfig(routerConfigPath)
+	if err != nil {
+		log.Printf("Failed to load routes from %v: %v", routerConfigPath, err)
+		return
+	}
+	currentRouter.Store(router)
+	log.Printf("Loaded %v routes (plus default: %v) from %v",
+		len(router.routes), router.deflt != nil, routerConfigPath)
+}
+
+// resolveRoute sniffs c's connection and matches it against router, writing
+// the result (and its own creader peek) so Handle can dial the right
+// backend.
+func (c *Connection) resolveRoute(router *Router) (*Route, error) {
+	prefix, sni, host := sniffClientHello(c.creader)
+
+	var clientIP net.IP
+	if tcpAddr, ok := c.clientAddr.(*net.TCPAddr); ok {
+		clientIP = tcpAddr.IP
+	}
+
+	route := router.Resolve(clientIP, sni, host, prefix)
+	if route == nil {
+		return nil, fmt.Errorf("no route matched (sni=%q host=%q) and no default route configured", sni, host)
+	}
+	return route, nil
+}
@@ -0,0 +1,117 @@
+// (c) 2017 - Bas Westerbaan <bas@westerbaan.name>
+// You may redistribute this file under the conditions of the GPLv3.
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRouteMatches(t *testing.T) {
+	_, cidr, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatalf("ParseCIDR: %v", err)
+	}
+
+	cases := []struct {
+		name   string
+		route  Route
+		ip     net.IP
+		sni    string
+		host   string
+		prefix []byte
+		want   bool
+	}{
+		{"sni match", Route{SNI: "api.example.com"}, nil, "api.example.com", "", nil, true},
+		{"sni mismatch", Route{SNI: "api.example.com"}, nil, "other.example.com", "", nil, false},
+		{"host match", Route{Host: "api.example.com"}, nil, "", "api.example.com", nil, true},
+		{"cidr match", Route{CIDR: "10.0.0.0/8", parsedCIDR: cidr}, net.ParseIP("10.1.2.3"), "", "", nil, true},
+		{"cidr mismatch", Route{CIDR: "10.0.0.0/8", parsedCIDR: cidr}, net.ParseIP("192.168.1.1"), "", "", nil, false},
+		{"prefix match", Route{Prefix: "GET "}, nil, "", "", []byte("GET / HTTP/1.1"), true},
+		{"prefix mismatch", Route{Prefix: "GET "}, nil, "", "", []byte("POST / HTTP/1.1"), false},
+		{"no selector configured", Route{}, nil, "whatever", "whatever", []byte("whatever"), false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := c.route.matches(c.ip, c.sni, c.host, c.prefix)
+			if got != c.want {
+				t.Errorf("matches() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestRouterResolve(t *testing.T) {
+	api := &Route{Name: "api", Host: "api.example.com"}
+	internal := &Route{Name: "internal", CIDR: "10.0.0.0/8"}
+	if err := internal.resolve(); err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	deflt := &Route{Name: "default"}
+
+	r := &Router{routes: []*Route{api, internal}, deflt: deflt}
+
+	if got := r.Resolve(nil, "", "api.example.com", nil); got != api {
+		t.Errorf("Resolve matched %v, want the api route", got.Name)
+	}
+	if got := r.Resolve(net.ParseIP("10.9.9.9"), "", "", nil); got != internal {
+		t.Errorf("Resolve matched %v, want the internal route", got.Name)
+	}
+	if got := r.Resolve(nil, "", "unmatched.example.com", nil); got != deflt {
+		t.Errorf("Resolve matched %v, want the default route", got.Name)
+	}
+}
+
+func TestRouterResolveNoDefault(t *testing.T) {
+	r := &Router{routes: []*Route{{Name: "api", Host: "api.example.com"}}}
+	if got := r.Resolve(nil, "", "unmatched.example.com", nil); got != nil {
+		t.Errorf("Resolve matched %v, want nil with no default route", got.Name)
+	}
+}
+
+func TestLoadRouterConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "routes.json")
+	const config = `{
+		"routes": [
+			{"name": "api", "host": "api.example.com", "backend": "127.0.0.1:8080"},
+			{"name": "internal", "cidr": "10.0.0.0/8", "backend": "127.0.0.1:8081", "skip_guardian": true}
+		],
+		"default": {"name": "fallback", "backend": "127.0.0.1:8082"}
+	}`
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	r, err := LoadRouterConfig(path)
+	if err != nil {
+		t.Fatalf("LoadRouterConfig: %v", err)
+	}
+	if len(r.routes) != 2 {
+		t.Fatalf("len(routes) = %v, want 2", len(r.routes))
+	}
+	if r.deflt == nil || r.deflt.Name != "fallback" {
+		t.Fatalf("default route = %+v, want fallback", r.deflt)
+	}
+	if !r.routes[1].SkipGuardian {
+		t.Errorf("internal route SkipGuardian = false, want true")
+	}
+	if r.routes[0].resolvedBackend == nil || r.routes[0].resolvedBackend.Port != 8080 {
+		t.Errorf("api route resolvedBackend = %v, want port 8080", r.routes[0].resolvedBackend)
+	}
+}
+
+func TestLoadRouterConfigBadBackend(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "routes.json")
+	const config = `{"routes": [{"name": "bad", "host": "x", "backend": "not a valid address"}]}`
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if _, err := LoadRouterConfig(path); err == nil {
+		t.Fatalf("LoadRouterConfig accepted an unresolvable backend")
+	}
+}
@@ -0,0 +1,82 @@
+// (c) 2017 - Bas Westerbaan <bas@westerbaan.name>
+// You may redistribute this file under the conditions of the GPLv3.
+
+// This file peeks at the first bytes a client sends, without consuming
+// them, to extract a TLS SNI or HTTP Host header for router.go's Route
+// matching.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// sniffBufferSize bounds how much of the connection Connection.creader
+// will buffer in order to sniff a route: enough for a typical ClientHello
+// or the request line and Host header of an HTTP request.
+const sniffBufferSize = 1024
+
+// sniffClientHello peeks at the first bytes the client sent (without
+// consuming them from r) and tries to extract a TLS SNI and an HTTP Host
+// header. Either may come back empty if sniffing didn't apply or the
+// prefix was too short to tell.
+func sniffClientHello(r *bufio.Reader) (prefix []byte, sni, host string) {
+	prefix, _ = r.Peek(sniffBufferSize)
+	return prefix, sniffSNI(prefix), sniffHost(prefix)
+}
+
+var errAbortAfterSNI = errors.New("sniff: aborting handshake after extracting SNI")
+
+// sniffSNI extracts the SNI from what looks like the start of a TLS
+// ClientHello. It runs the standard library's TLS server handshake code
+// against the peeked prefix and aborts as soon as GetConfigForClient is
+// called back with the parsed ClientHelloInfo, so the handshake never
+// actually has to succeed. Returns "" if prefix isn't a ClientHello, or has
+// no SNI extension.
+func sniffSNI(prefix []byte) string {
+	var sni string
+	cfg := &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni = hello.ServerName
+			return nil, errAbortAfterSNI
+		},
+	}
+	tls.Server(&peekedConn{r: bytes.NewReader(prefix)}, cfg).Handshake()
+	return sni
+}
+
+// sniffHost extracts the Host header from what looks like the start of an
+// HTTP/1.x request. Returns "" if prefix doesn't parse as one; a prefix
+// truncated after the request line and headers is fine, since that is all
+// http.ReadRequest needs to populate Host.
+func sniffHost(prefix []byte) string {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(prefix)))
+	if err != nil {
+		return ""
+	}
+	return req.Host
+}
+
+// peekedConn adapts a peeked byte slice to a net.Conn, just enough for
+// tls.Server's handshake code to read a ClientHello from it. Everything
+// else (addresses, deadlines, writes) is a no-op or an error: we only ever
+// read the sniffed prefix, never hold this open as a real connection.
+type peekedConn struct {
+	r *bytes.Reader
+}
+
+func (p *peekedConn) Read(b []byte) (int, error) { return p.r.Read(b) }
+func (p *peekedConn) Write(b []byte) (int, error) {
+	return 0, errors.New("peekedConn: write not supported")
+}
+func (p *peekedConn) Close() error                       { return nil }
+func (p *peekedConn) LocalAddr() net.Addr                { return nil }
+func (p *peekedConn) RemoteAddr() net.Addr               { return nil }
+func (p *peekedConn) SetDeadline(t time.Time) error      { return nil }
+func (p *peekedConn) SetReadDeadline(t time.Time) error  { return nil }
+func (p *peekedConn) SetWriteDeadline(t time.Time) error { return nil }
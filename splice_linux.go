@@ -0,0 +1,236 @@
+// (c) 2017 - Bas Westerbaan <bas@westerbaan.name>
+// You may redistribute this file under the conditions of the GPLv3.
+
+//go:build linux
+
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+const (
+	// spliceFMove mirrors Linux's SPLICE_F_MOVE: hint to move pages instead
+	// of copying them, where the kernel supports it.
+	spliceFMove = 0x1
+	// spliceChunk bounds a single splice(2) call to the kernel pipe buffer
+	// size, so we never ask for more than the cached pipe can hold.
+	spliceChunk = 1 << 16
+)
+
+// spliceBytesTotal and copyBytesTotal count bytes moved via splice(2) and
+// via a userspace io.Copy fallback respectively, so the gain from -splice
+// can be observed in the logs (see logSpliceMetrics in main.go).
+var spliceBytesTotal int64
+var copyBytesTotal int64
+
+// splicePipe is a pipe pair cached per Connection and direction so that
+// repeated splices between the same two sockets don't pay for a pipe(2)
+// syscall every time.
+type splicePipe struct {
+	r, w *os.File
+}
+
+func newSplicePipe() (*splicePipe, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	return &splicePipe{r: r, w: w}, nil
+}
+
+func (p *splicePipe) Close() {
+	p.r.Close()
+	p.w.Close()
+}
+
+// splicePipeKey identifies a cached pipe by connection id and pump
+// direction. A SkipGuardian route runs RunClientToProxeePump and
+// RunProxeeToClientPump concurrently for the same connection id, so keying
+// on id alone would hand both directions the same pipe and let the two
+// independent byte streams interleave through it.
+type splicePipeKey struct {
+	id  int
+	dir string
+}
+
+var (
+	splicePipesMu sync.Mutex
+	splicePipes   = make(map[splicePipeKey]*splicePipe)
+)
+
+func splicePipeFor(id int, dir string) (*splicePipe, error) {
+	key := splicePipeKey{id, dir}
+	splicePipesMu.Lock()
+	defer splicePipesMu.Unlock()
+	if p, ok := splicePipes[key]; ok {
+		return p, nil
+	}
+	p, err := newSplicePipe()
+	if err != nil {
+		return nil, err
+	}
+	splicePipes[key] = p
+	return p, nil
+}
+
+// cleanupSplice releases all pipes cached for a connection (one per
+// direction that ever used splice), if any. It is called once
+// Connection.Handle returns.
+func cleanupSplice(id int) {
+	splicePipesMu.Lock()
+	var toClose []*splicePipe
+	for key, p := range splicePipes {
+		if key.id == id {
+			toClose = append(toClose, p)
+			delete(splicePipes, key)
+		}
+	}
+	splicePipesMu.Unlock()
+	for _, p := range toClose {
+		p.Close()
+	}
+}
+
+// spliceMetrics reports the running totals of bytes moved via splice(2) vs.
+// a userspace copy.
+func spliceMetrics() (spliced, copied int64) {
+	return atomic.LoadInt64(&spliceBytesTotal), atomic.LoadInt64(&copyBytesTotal)
+}
+
+// pump moves bytes from src to dst. When -splice allows it, it uses
+// splice(2) through a cached pipe so the payload never touches a Go heap
+// buffer; on any splice error (including -splice=off or a non-socket pipe
+// running out) it falls back to io.Copy, which on Linux also ends up
+// calling splice(2) via TCPConn.ReadFrom, just without our own accounting
+// or pipe caching. dir identifies the pump direction (e.g.
+// "proxee_to_client") so concurrent pumps for the same connection never
+// share a pipe.
+func (c *Connection) pump(dst, src *net.TCPConn, dir string) error {
+	if splice_mode == "off" {
+		return c.copyFallback(dst, src)
+	}
+
+	pipe, err := splicePipeFor(c.id, dir)
+	if err != nil {
+		return c.copyFallback(dst, src)
+	}
+
+	n, err := c.splice(dst, src, pipe)
+	atomic.AddInt64(&spliceBytesTotal, n)
+	if err == nil {
+		return nil
+	}
+
+	// Something about this pair of sockets doesn't support splice (e.g. a
+	// TLS-terminating wrapper was layered on top some day); fall back to
+	// io.Copy for whatever is left.
+	rest, cerr := io.Copy(deadlineWriter{dst}, deadlineReader{src})
+	atomic.AddInt64(&copyBytesTotal, rest)
+	return cerr
+}
+
+func (c *Connection) copyFallback(dst, src *net.TCPConn) error {
+	n, err := io.Copy(deadlineWriter{dst}, deadlineReader{src})
+	atomic.AddInt64(&copyBytesTotal, n)
+	return err
+}
+
+// deadlineReader/deadlineWriter refresh a *net.TCPConn's idle deadline
+// before every Read/Write, used by copyFallback so -idle-timeout is
+// enforced there too.
+type deadlineReader struct{ conn *net.TCPConn }
+
+func (r deadlineReader) Read(p []byte) (int, error) {
+	setReadDeadline(r.conn, idle_timeout)
+	return r.conn.Read(p)
+}
+
+type deadlineWriter struct{ conn *net.TCPConn }
+
+func (w deadlineWriter) Write(p []byte) (int, error) {
+	setWriteDeadline(w.conn, idle_timeout)
+	return w.conn.Write(p)
+}
+
+// splice pumps src -> dst through the given pipe using splice(2), without
+// copying the payload into a Go heap buffer. It returns the number of bytes
+// moved and the first error encountered (io.EOF is reported as nil). The
+// idle deadline on both ends is refreshed before every splice(2) call.
+func (c *Connection) splice(dst, src *net.TCPConn, pipe *splicePipe) (int64, error) {
+	srcRaw, err := src.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	dstRaw, err := dst.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for {
+		setReadDeadline(src, idle_timeout)
+		nread, err := spliceInto(srcRaw, int(pipe.w.Fd()))
+		if err != nil {
+			return total, err
+		}
+		if nread == 0 {
+			return total, nil // src reached EOF
+		}
+
+		for nread > 0 {
+			setWriteDeadline(dst, idle_timeout)
+			nwritten, err := spliceFrom(dstRaw, int(pipe.r.Fd()), nread)
+			if err != nil {
+				return total, err
+			}
+			nread -= nwritten
+			total += int64(nwritten)
+		}
+	}
+}
+
+// spliceInto splices up to spliceChunk bytes from the raw connection into
+// the write end of the pipe (fd wfd), retrying while the kernel reports
+// EAGAIN.
+func spliceInto(raw syscall.RawConn, wfd int) (int, error) {
+	var n int
+	var serr error
+	cerr := raw.Read(func(fd uintptr) bool {
+		n, serr = spliceSyscall(int(fd), wfd, spliceChunk)
+		return serr != syscall.EAGAIN
+	})
+	if cerr != nil {
+		return 0, cerr
+	}
+	return n, serr
+}
+
+// spliceFrom splices up to n bytes from the read end of the pipe (fd rfd)
+// into the raw connection, retrying while the kernel reports EAGAIN.
+func spliceFrom(raw syscall.RawConn, rfd int, n int) (int, error) {
+	var written int
+	var serr error
+	cerr := raw.Write(func(fd uintptr) bool {
+		written, serr = spliceSyscall(rfd, int(fd), n)
+		return serr != syscall.EAGAIN
+	})
+	if cerr != nil {
+		return 0, cerr
+	}
+	return written, serr
+}
+
+func spliceSyscall(rfd, wfd, n int) (int, error) {
+	r1, _, errno := syscall.Syscall6(syscall.SYS_SPLICE,
+		uintptr(rfd), 0, uintptr(wfd), 0, uintptr(n), uintptr(spliceFMove))
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(r1), nil
+}
@@ -0,0 +1,56 @@
+// (c) 2017 - Bas Westerbaan <bas@westerbaan.name>
+// You may redistribute this file under the conditions of the GPLv3.
+
+//go:build !linux
+
+package main
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+// copyBytesTotal counts bytes moved through io.Copy. On non-Linux builds
+// this is the only path; splice(2) is Linux-only.
+var copyBytesTotal int64
+
+// pump copies from src to dst with io.Copy. splice(2) is not available on
+// this platform, so -splice is silently ignored here and dir (the pump
+// direction, used on Linux to key the cached splice pipe) is unused. The
+// idle deadline on both ends is refreshed on every Read/Write so a stalled
+// pump doesn't pin the connection open forever.
+func (c *Connection) pump(dst, src *net.TCPConn, dir string) error {
+	n, err := io.Copy(
+		deadlineWriter{dst},
+		deadlineReader{src})
+	atomic.AddInt64(&copyBytesTotal, n)
+	return err
+}
+
+// deadlineReader/deadlineWriter refresh a *net.TCPConn's idle deadline
+// before every Read/Write, so io.Copy's internal loop enforces -idle-timeout
+// without us having to reimplement the copy loop.
+type deadlineReader struct{ conn *net.TCPConn }
+
+func (r deadlineReader) Read(p []byte) (int, error) {
+	setReadDeadline(r.conn, idle_timeout)
+	return r.conn.Read(p)
+}
+
+type deadlineWriter struct{ conn *net.TCPConn }
+
+func (w deadlineWriter) Write(p []byte) (int, error) {
+	setWriteDeadline(w.conn, idle_timeout)
+	return w.conn.Write(p)
+}
+
+// cleanupSplice is a no-op on non-Linux builds: there is no cached pipe to
+// release.
+func cleanupSplice(id int) {}
+
+// spliceMetrics reports the running totals of bytes moved via splice(2) vs.
+// a userspace copy. Splice is never used on this platform.
+func spliceMetrics() (spliced, copied int64) {
+	return 0, atomic.LoadInt64(&copyBytesTotal)
+}